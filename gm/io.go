@@ -7,6 +7,7 @@ package gm
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 
 	"code.google.com/p/gosl/utl"
 )
@@ -21,32 +22,49 @@ func HashPoint(x, y, z float64) int {
 }
 
 // WriteMshD writes .msh file
-// Input: vtagged maps hashed id of control point to vertex tag
+// Input: vtagged maps HashPoint(x,y,z) of a control point to its vertex tag (this
+//        lookup is independent of how points are deduplicated internally, see
+//        PointIndex)
 //        ctagged maps idOfNurbs_localIdOfElem to cell tag
 func WriteMshD(dirout, fnk string, nurbss []*Nurbs, vtagged map[int]int, ctagged map[string]int) {
 	var buf bytes.Buffer
 	utl.Ff(&buf, "{\n  \"verts\" : [\n")
-	verts := make(map[int]int)
-	vid := 0
+
+	// control points are deduplicated with a PointIndex rather than HashPoint directly,
+	// so that coincident points with different weights aren't merged and models with
+	// very large or very small coordinates don't silently fold distinct vertices
+	// together (see PointIndex for why HashPoint alone can't guarantee either)
+	var allPts [][]float64
+	for _, o := range nurbss {
+		for k := 0; k < o.n[2]; k++ {
+			for j := 0; j < o.n[1]; j++ {
+				for i := 0; i < o.n[0]; i++ {
+					allPts = append(allPts, o.GetQ(i, j, k))
+				}
+			}
+		}
+	}
+	pidx := NewPointIndex(DefaultPointTol(allPts))
+
+	first := true
 	for _, o := range nurbss {
 		for k := 0; k < o.n[2]; k++ {
 			for j := 0; j < o.n[1]; j++ {
 				for i := 0; i < o.n[0]; i++ {
 					x := o.GetQ(i, j, k)
-					hsh := HashPoint(x[0], x[1], x[2])
-					if _, ok := verts[hsh]; !ok {
+					id, isNew := pidx.Add(x[0], x[1], x[2], x[3])
+					if isNew {
 						tag := 0
 						if vtagged != nil {
-							if val, tok := vtagged[hsh]; tok {
+							if val, tok := vtagged[HashPoint(x[0], x[1], x[2])]; tok {
 								tag = val
 							}
 						}
-						if len(verts) > 0 {
+						if !first {
 							utl.Ff(&buf, ",\n")
 						}
-						utl.Ff(&buf, "    { \"id\":%3d, \"tag\":%3d, \"c\":[%24.17e,%24.17e,%24.17e,%24.17e] }", vid, tag, x[0], x[1], x[2], x[3])
-						verts[hsh] = vid
-						vid += 1
+						utl.Ff(&buf, "    { \"id\":%3d, \"tag\":%3d, \"c\":[%24.17e,%24.17e,%24.17e,%24.17e] }", id, tag, x[0], x[1], x[2], x[3])
+						first = false
 					}
 				}
 			}
@@ -73,19 +91,17 @@ func WriteMshD(dirout, fnk string, nurbss []*Nurbs, vtagged map[int]int, ctagged
 			utl.Ff(&buf, "]")
 		}
 		utl.Ff(&buf, "\n      ],\n      \"ctrls\":[")
-		first := true
+		firstCtrl := true
 		for k := 0; k < o.n[2]; k++ {
 			for j := 0; j < o.n[1]; j++ {
 				for i := 0; i < o.n[0]; i++ {
-					if !first {
+					if !firstCtrl {
 						utl.Ff(&buf, ",")
 					}
 					x := o.GetQ(i, j, k)
-					hsh := HashPoint(x[0], x[1], x[2])
-					utl.Ff(&buf, "%d", verts[hsh])
-					if first {
-						first = false
-					}
+					id, _ := pidx.Add(x[0], x[1], x[2], x[3])
+					utl.Ff(&buf, "%d", id)
+					firstCtrl = false
 				}
 			}
 		}
@@ -120,8 +136,8 @@ func WriteMshD(dirout, fnk string, nurbss []*Nurbs, vtagged map[int]int, ctagged
 					utl.Ff(&buf, ",")
 				}
 				x := o.GetQl(l)
-				hsh := HashPoint(x[0], x[1], x[2])
-				utl.Ff(&buf, "%d", verts[hsh])
+				id, _ := pidx.Add(x[0], x[1], x[2], x[3])
+				utl.Ff(&buf, "%d", id)
 			}
 			utl.Ff(&buf, "] }")
 			cid += 1
@@ -147,20 +163,98 @@ type NurbsD struct {
 	Ctrls []int       // global ids of control points
 }
 
+// CellD holds the data WriteMshD stores for one element under "cells": which NURBS
+// (patch) it belongs to, its boundary tag, and the knot-span / vertex-id tables needed
+// to place it without recomputing anything from the NURBS itself
+type CellD struct {
+	Id    int   // id
+	Tag   int   // tag (-1 if untagged)
+	Nrb   int   // id of owning NURBS
+	Part  int   // partition (currently always 0)
+	Geo   int   // geometry type (see NURBS_GEO)
+	Span  []int // knot-span index, one per parametric direction
+	Verts []int // global ids of the element's corner control points
+}
+
 // Data holds all geometry data
 type Data struct {
 	Verts  []Vert   // vertices
 	Nurbss []NurbsD // NURBSs
+	Cells  []CellD  // cells (elements)
+}
+
+// Build constructs the []*Nurbs described by d, together with the vtagged/ctagged maps
+// WriteMshD accepts, recovering them from d.Verts' and d.Cells' tags. ReadMshFull calls
+// it on the Data it unmarshals from a .msh file, and a Data assembled by hand can be
+// turned back into the arguments WriteMshD wants the same way, without the caller
+// re-deriving them.
+func (d *Data) Build() (nurbss []*Nurbs, vtagged map[int]int, ctagged map[string]int) {
+
+	// list of vertices, and vtagged keyed the same way WriteMshD queries it
+	verts := make([][]float64, len(d.Verts))
+	vtagged = make(map[int]int)
+	for i, v := range d.Verts {
+		verts[i] = make([]float64, 4)
+		for j := 0; j < 4; j++ {
+			verts[i][j] = v.C[j]
+		}
+		if v.Tag != 0 {
+			vtagged[HashPoint(verts[i][0], verts[i][1], verts[i][2])] = v.Tag
+		}
+	}
+
+	// allocate NURBSs
+	nurbss = make([]*Nurbs, len(d.Nurbss))
+	for i, v := range d.Nurbss {
+		nurbss[i] = new(Nurbs)
+		nurbss[i].Init(v.Gnd, v.Ords, v.Knots)
+		nurbss[i].SetControl(verts, v.Ctrls)
+	}
+
+	// ctagged, keyed idOfNurbs_localIdOfElem; d.Cells lists every NURBS' elements in
+	// order, so the local id is just a per-Nrb counter over them
+	ctagged = make(map[string]int)
+	localId := make(map[int]int)
+	for _, c := range d.Cells {
+		eid := localId[c.Nrb]
+		localId[c.Nrb] = eid + 1
+		if c.Tag != -1 {
+			ctagged[utl.Sf("%d_%d", c.Nrb, eid)] = c.Tag
+		}
+	}
+	return
+}
+
+// WriteMsh serializes d to dirout/fnk.msh, the symmetric counterpart of ReadMshFull: it
+// calls d.Build to recover WriteMshD's arguments and writes them out.
+func (d *Data) WriteMsh(dirout, fnk string) {
+	nurbss, vtagged, ctagged := d.Build()
+	WriteMshD(dirout, fnk, nurbss, vtagged, ctagged)
 }
 
-// ReadMsh reads .msh file
+// ReadMsh reads a mesh file written by WriteMshD (JSON, the interchange default) or
+// WriteMshB (binary .mshb), auto-detecting the format by sniffing the first bytes: a
+// leading '{' means JSON, the "GOSLMSHB" magic means binary.
 func ReadMsh(fnk string) (nurbss []*Nurbs) {
 
-	// read file
+	// read file, preferring the JSON .msh but falling back to binary .mshb
 	fn := fnk + ".msh"
 	buf, err := utl.ReadFile(fn)
 	if err != nil {
-		utl.Panic(_io_err1, fn, err)
+		fn = fnk + ".mshb"
+		buf, err = utl.ReadFile(fn)
+		if err != nil {
+			utl.Panic(_io_err1, fnk+".msh", err)
+		}
+	}
+
+	// binary format
+	if looksLikeMshB(buf) {
+		nurbss, err = parseMshBBytes(buf, fn)
+		if err != nil {
+			utl.Panic(_io_err2, fn, err)
+		}
+		return
 	}
 
 	// decode
@@ -169,23 +263,31 @@ func ReadMsh(fnk string) (nurbss []*Nurbs) {
 	if err != nil {
 		utl.Panic(_io_err2, fn, err)
 	}
+	nurbss, _, _ = dat.Build()
+	return
+}
 
-	// list of vertices
-	verts := make([][]float64, len(dat.Verts))
-	for i, _ := range dat.Verts {
-		verts[i] = make([]float64, 4)
-		for j := 0; j < 4; j++ {
-			verts[i][j] = dat.Verts[i].C[j]
-		}
+// ReadMshFull is ReadMsh plus the vtagged/ctagged maps WriteMshD accepts and the raw
+// cell records, recovered from the tags the JSON file carries (ReadMsh drops them; a
+// Data unmarshalled from the file keeps them only as Verts[].Tag and Cells). It only
+// understands the JSON .msh
+// format: .mshb carries no tags to recover.
+func ReadMshFull(fnk string) (nurbss []*Nurbs, vtagged map[int]int, ctagged map[string]int, cells []CellD, err error) {
+	fn := fnk + ".msh"
+	buf, err := utl.ReadFile(fn)
+	if err != nil {
+		return
 	}
-
-	// allocate NURBSs
-	nurbss = make([]*Nurbs, len(dat.Nurbss))
-	for i, v := range dat.Nurbss {
-		nurbss[i] = new(Nurbs)
-		nurbss[i].Init(v.Gnd, v.Ords, v.Knots)
-		nurbss[i].SetControl(verts, v.Ctrls)
+	if looksLikeMshB(buf) {
+		err = fmt.Errorf("ReadMshFull: '%s' is a binary .mshb file, which does not store tags", fn)
+		return
+	}
+	var dat Data
+	if err = json.Unmarshal(buf, &dat); err != nil {
+		return
 	}
+	nurbss, vtagged, ctagged = dat.Build()
+	cells = dat.Cells
 	return
 }
 
@@ -0,0 +1,452 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"code.google.com/p/gosl/utl"
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// binary .mshb file layout:
+//
+//   magic[8]   "GOSLMSHB"
+//   version[1] mshbVersion
+//   flags[1]   bit 0: payload is Snappy-compressed
+//   nEntries   uint32
+//   toc        [nEntries]{ id int32, offset int64, length int64 }  // offsets into data section
+//   data       concatenation of per-NURBS records, one per toc entry
+//
+// when flags&1 is set, everything from "nEntries" onwards is compressed as a single
+// Snappy block; in that case the toc can still be used to slice the *decompressed*
+// payload, but random access without decompressing the whole file is not possible.
+const (
+	mshbMagic      = "GOSLMSHB"
+	mshbVersion    = byte(1)
+	mshbFlagSnappy = byte(1) << 0
+)
+
+// mshbEntry is one table-of-contents record in a binary .mshb file
+type mshbEntry struct {
+	Id     int32
+	Offset int64
+	Length int64
+}
+
+// validateMshBEntry checks e's Offset/Length against dataLen, the number of bytes
+// actually available in the data section, before anything slices or seeks into it. A
+// truncated or corrupted .mshb file (or any file that merely sniffs as one via
+// looksLikeMshB) whose table-of-contents points outside the data section fails with an
+// error here rather than panic with a slice-bounds or read past EOF.
+func validateMshBEntry(e mshbEntry, dataLen int64) error {
+	if e.Offset < 0 || e.Length < 0 {
+		return fmt.Errorf("mshb entry %d: negative offset/length (%d/%d)", e.Id, e.Offset, e.Length)
+	}
+	if e.Offset > dataLen || e.Length > dataLen-e.Offset {
+		return fmt.Errorf("mshb entry %d: record [%d,%d) exceeds data section length %d", e.Id, e.Offset, e.Offset+e.Length, dataLen)
+	}
+	return nil
+}
+
+// WriteMshB writes a binary .mshb file holding the control points, knot vectors and
+// element span/vertex tables of nurbss. Records are self-contained per NURBS (no
+// cross-patch vertex deduplication) so that, when compress is false, any single NURBS
+// can later be read back via ReadMshBOne without decoding the rest of the file. When
+// compress is true, the whole table-of-contents+data payload is Snappy-compressed.
+func WriteMshB(dirout, fnk string, nurbss []*Nurbs, compress bool) (err error) {
+	var data bytes.Buffer
+	entries := make([]mshbEntry, len(nurbss))
+	for sid, o := range nurbss {
+		var rec bytes.Buffer
+		if err = encodeNurbsB(&rec, sid, o); err != nil {
+			return
+		}
+		entries[sid] = mshbEntry{Id: int32(sid), Offset: int64(data.Len()), Length: int64(rec.Len())}
+		data.Write(rec.Bytes())
+	}
+
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.LittleEndian, uint32(len(entries)))
+	for _, e := range entries {
+		binary.Write(&payload, binary.LittleEndian, e)
+	}
+	payload.Write(data.Bytes())
+
+	var out bytes.Buffer
+	out.WriteString(mshbMagic)
+	out.WriteByte(mshbVersion)
+	if compress {
+		out.WriteByte(mshbFlagSnappy)
+		comp, cerr := snappy.Encode(nil, payload.Bytes())
+		if cerr != nil {
+			return fmt.Errorf("WriteMshB: snappy compression failed: %v", cerr)
+		}
+		out.Write(comp)
+	} else {
+		out.WriteByte(0)
+		out.Write(payload.Bytes())
+	}
+
+	utl.WriteFileVD(dirout, fnk+".mshb", &out)
+	return
+}
+
+// encodeNurbsB writes the binary record for one NURBS: id, orders, knot vectors,
+// control-point grid (with weights) and the per-element span/vertex tables.
+func encodeNurbsB(w *bytes.Buffer, sid int, o *Nurbs) (err error) {
+	binary.Write(w, binary.LittleEndian, int32(sid))
+	binary.Write(w, binary.LittleEndian, int32(o.gnd))
+	binary.Write(w, binary.LittleEndian, [3]int32{int32(o.p[0]), int32(o.p[1]), int32(o.p[2])})
+	for d := 0; d < o.gnd; d++ {
+		binary.Write(w, binary.LittleEndian, int32(len(o.b[d].T)))
+		binary.Write(w, binary.LittleEndian, o.b[d].T)
+	}
+	binary.Write(w, binary.LittleEndian, [3]int32{int32(o.n[0]), int32(o.n[1]), int32(o.n[2])})
+	for k := 0; k < o.n[2]; k++ {
+		for j := 0; j < o.n[1]; j++ {
+			for i := 0; i < o.n[0]; i++ {
+				x := o.GetQ(i, j, k)
+				binary.Write(w, binary.LittleEndian, [4]float64{x[0], x[1], x[2], x[3]})
+			}
+		}
+	}
+	elems := o.Elements()
+	enodes := o.Enodes()
+	binary.Write(w, binary.LittleEndian, int32(len(elems)))
+	for eid, e := range elems {
+		binary.Write(w, binary.LittleEndian, int32(len(e)))
+		for _, idx := range e {
+			binary.Write(w, binary.LittleEndian, int32(idx))
+		}
+		verts := enodes[eid]
+		binary.Write(w, binary.LittleEndian, int32(len(verts)))
+		for _, l := range verts {
+			binary.Write(w, binary.LittleEndian, int32(l))
+		}
+	}
+	return
+}
+
+// decodeNurbsB reads one binary NURBS record written by encodeNurbsB. The element
+// span/vertex tables are decoded and discarded since they're recomputed on demand by
+// (*Nurbs).Elements/Enodes; only the geometry (orders, knots, control net) is needed to
+// reconstruct the NURBS.
+func decodeNurbsB(r io.Reader) (sid int, o *Nurbs, err error) {
+	var id, gnd int32
+	if err = binary.Read(r, binary.LittleEndian, &id); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.LittleEndian, &gnd); err != nil {
+		return
+	}
+	var p [3]int32
+	if err = binary.Read(r, binary.LittleEndian, &p); err != nil {
+		return
+	}
+	knots := make([][]float64, gnd)
+	for d := 0; d < int(gnd); d++ {
+		var nt int32
+		if err = binary.Read(r, binary.LittleEndian, &nt); err != nil {
+			return
+		}
+		knots[d] = make([]float64, nt)
+		if err = binary.Read(r, binary.LittleEndian, knots[d]); err != nil {
+			return
+		}
+	}
+	var n [3]int32
+	if err = binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return
+	}
+	nctrl := int(n[0]) * int(n[1]) * int(n[2])
+	ctrls := make([][]float64, nctrl)
+	for c := 0; c < nctrl; c++ {
+		var x [4]float64
+		if err = binary.Read(r, binary.LittleEndian, &x); err != nil {
+			return
+		}
+		ctrls[c] = []float64{x[0], x[1], x[2], x[3]}
+	}
+	var nelems int32
+	if err = binary.Read(r, binary.LittleEndian, &nelems); err != nil {
+		return
+	}
+	for e := int32(0); e < nelems; e++ {
+		var nspan int32
+		if err = binary.Read(r, binary.LittleEndian, &nspan); err != nil {
+			return
+		}
+		if _, err = io.CopyN(ioutil.Discard, r, 4*int64(nspan)); err != nil {
+			return
+		}
+		var nverts int32
+		if err = binary.Read(r, binary.LittleEndian, &nverts); err != nil {
+			return
+		}
+		if _, err = io.CopyN(ioutil.Discard, r, 4*int64(nverts)); err != nil {
+			return
+		}
+	}
+
+	o = new(Nurbs)
+	ords := []int{int(p[0]), int(p[1]), int(p[2])}
+	o.Init(int(gnd), ords, knots)
+	ids := make([]int, nctrl)
+	for i := range ids {
+		ids[i] = i
+	}
+	o.SetControl(ctrls, ids)
+	sid = int(id)
+	return
+}
+
+// looksLikeMshB reports whether buf opens with the binary .mshb magic header; this is
+// what ReadMsh sniffs to auto-detect the format of a file on read
+func looksLikeMshB(buf []byte) bool {
+	return len(buf) >= len(mshbMagic) && string(buf[:len(mshbMagic)]) == mshbMagic
+}
+
+// decodeMshBHeader strips the magic/version/flags header off raw .mshb bytes already in
+// memory and decompresses the table-of-contents+data payload if necessary
+func decodeMshBHeader(buf []byte, fn string) (payload []byte, err error) {
+	if !looksLikeMshB(buf) {
+		return nil, fmt.Errorf("decodeMshBHeader: '%s' is not a valid .mshb file", fn)
+	}
+	pos := len(mshbMagic)
+	version := buf[pos]
+	pos++
+	if version != mshbVersion {
+		return nil, fmt.Errorf("decodeMshBHeader: '%s' has unsupported version %d", fn, version)
+	}
+	flags := buf[pos]
+	pos++
+	if flags&mshbFlagSnappy != 0 {
+		return snappy.Decode(nil, buf[pos:])
+	}
+	return buf[pos:], nil
+}
+
+// readMshBPayload reads a .mshb file from disk and decodes its header, returning the
+// (possibly decompressed) table-of-contents+data payload
+func readMshBPayload(fn string) (payload []byte, err error) {
+	buf, err := utl.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMshBHeader(buf, fn)
+}
+
+// parseMshBBytes decodes every NURBS out of raw .mshb file bytes already in memory; it
+// backs both ReadMshB and the auto-detection in ReadMsh
+func parseMshBBytes(buf []byte, fn string) (nurbss []*Nurbs, err error) {
+	payload, err := decodeMshBHeader(buf, fn)
+	if err != nil {
+		return
+	}
+	entries, dataOff, err := readMshBToc(payload)
+	if err != nil {
+		return
+	}
+	dataLen := int64(len(payload) - dataOff)
+	nurbss = make([]*Nurbs, len(entries))
+	for _, e := range entries {
+		if verr := validateMshBEntry(e, dataLen); verr != nil {
+			return nil, fmt.Errorf("parseMshBBytes: '%s': %v", fn, verr)
+		}
+		if e.Id < 0 || int(e.Id) >= len(entries) {
+			return nil, fmt.Errorf("parseMshBBytes: '%s': entry id %d out of range [0,%d)", fn, e.Id, len(entries))
+		}
+		start := dataOff + int(e.Offset)
+		end := start + int(e.Length)
+		_, o, derr := decodeNurbsB(bytes.NewReader(payload[start:end]))
+		if derr != nil {
+			return nil, derr
+		}
+		nurbss[e.Id] = o
+	}
+	return
+}
+
+// readMshBToc parses the table-of-contents at the start of a (decompressed) .mshb payload
+func readMshBToc(payload []byte) (entries []mshbEntry, dataOff int, err error) {
+	r := bytes.NewReader(payload)
+	var n uint32
+	if err = binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return
+	}
+	entries = make([]mshbEntry, n)
+	for i := range entries {
+		if err = binary.Read(r, binary.LittleEndian, &entries[i]); err != nil {
+			return
+		}
+	}
+	dataOff = len(payload) - r.Len()
+	return
+}
+
+// ReadMshB reads every NURBS stored in a binary .mshb file written by WriteMshB
+func ReadMshB(fnk string) (nurbss []*Nurbs, err error) {
+	fn := fnk + ".mshb"
+	buf, err := utl.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	return parseMshBBytes(buf, fn)
+}
+
+// ReadMshBOne reads a single NURBS, identified by its id (the index it had in the
+// nurbss slice passed to WriteMshB), from a binary .mshb file without decoding the
+// others. This only avoids decoding the rest of the file when the file is uncompressed;
+// a compressed file has to be decompressed in full regardless.
+func ReadMshBOne(fnk string, id int) (o *Nurbs, err error) {
+	payload, err := readMshBPayload(fnk + ".mshb")
+	if err != nil {
+		return
+	}
+	entries, dataOff, err := readMshBToc(payload)
+	if err != nil {
+		return
+	}
+	dataLen := int64(len(payload) - dataOff)
+	for _, e := range entries {
+		if int(e.Id) == id {
+			if verr := validateMshBEntry(e, dataLen); verr != nil {
+				return nil, fmt.Errorf("ReadMshBOne: '%s.mshb': %v", fnk, verr)
+			}
+			start := dataOff + int(e.Offset)
+			end := start + int(e.Length)
+			_, o, err = decodeNurbsB(bytes.NewReader(payload[start:end]))
+			return
+		}
+	}
+	return nil, fmt.Errorf("ReadMshBOne: no NURBS with id=%d in '%s.mshb'", id, fnk)
+}
+
+// MshBReader streams NURBSs one at a time out of a binary .mshb file, so that a
+// multi-patch model doesn't have to be held in memory all at once. Create one with
+// OpenMshB and pull records with Next until it returns io.EOF, then Close it.
+//
+// This bound only holds for uncompressed files: OpenMshB loads just the header and the
+// table-of-contents up front, and Next seeks to and reads one record at a time off
+// disk. A Snappy-compressed file cannot be seeked into without decompressing the whole
+// block first (see the .mshb layout comment at the top of this file), so for those OpenMshB falls back to
+// decoding the entire payload into memory; Next then slices it like any other decode-
+// on-demand reader. Write uncompressed .mshb files when memory-bounded reads matter.
+type MshBReader struct {
+	f          *os.File
+	compressed bool
+	payload    []byte
+	entries    []mshbEntry
+	dataOff    int64
+	size       int64 // file size, for bounds-checking entries in the uncompressed case
+	next       int
+}
+
+// OpenMshB opens a binary .mshb file for streaming reads
+func OpenMshB(fnk string) (r *MshBReader, err error) {
+	f, err := os.Open(fnk + ".mshb")
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			f.Close()
+		}
+	}()
+
+	var hdr [10]byte
+	if _, err = io.ReadFull(f, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(mshbMagic)]) != mshbMagic {
+		return nil, fmt.Errorf("OpenMshB: '%s.mshb' is not a valid .mshb file", fnk)
+	}
+	if hdr[8] != mshbVersion {
+		return nil, fmt.Errorf("OpenMshB: '%s.mshb' has unsupported version %d", fnk, hdr[8])
+	}
+
+	if hdr[9]&mshbFlagSnappy != 0 {
+		rest, rerr := ioutil.ReadAll(f)
+		if rerr != nil {
+			return nil, rerr
+		}
+		payload, derr := snappy.Decode(nil, rest)
+		if derr != nil {
+			return nil, derr
+		}
+		entries, dataOff, terr := readMshBToc(payload)
+		if terr != nil {
+			return nil, terr
+		}
+		f.Close()
+		opened = true
+		return &MshBReader{compressed: true, payload: payload, entries: entries, dataOff: int64(dataOff)}, nil
+	}
+
+	var n uint32
+	if err = binary.Read(f, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	entries := make([]mshbEntry, n)
+	for i := range entries {
+		if err = binary.Read(f, binary.LittleEndian, &entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	dataOff, serr := f.Seek(0, io.SeekCurrent)
+	if serr != nil {
+		return nil, serr
+	}
+	info, ierr := f.Stat()
+	if ierr != nil {
+		return nil, ierr
+	}
+	opened = true
+	return &MshBReader{f: f, entries: entries, dataOff: dataOff, size: info.Size()}, nil
+}
+
+// Next decodes and returns the next NURBS in the file, along with the id it was
+// written with. It returns io.EOF once every record has been read.
+func (r *MshBReader) Next() (id int, o *Nurbs, err error) {
+	if r.next >= len(r.entries) {
+		return 0, nil, io.EOF
+	}
+	e := r.entries[r.next]
+	r.next++
+	if r.compressed {
+		dataLen := int64(len(r.payload)) - r.dataOff
+		if verr := validateMshBEntry(e, dataLen); verr != nil {
+			return 0, nil, verr
+		}
+		start := int(r.dataOff) + int(e.Offset)
+		end := start + int(e.Length)
+		id, o, err = decodeNurbsB(bytes.NewReader(r.payload[start:end]))
+		return
+	}
+	if verr := validateMshBEntry(e, r.size-r.dataOff); verr != nil {
+		return 0, nil, verr
+	}
+	if _, err = r.f.Seek(r.dataOff+e.Offset, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	id, o, err = decodeNurbsB(io.LimitReader(r.f, e.Length))
+	return
+}
+
+// Close releases the underlying file handle. It is a no-op for a reader that fell back
+// to an in-memory decompressed payload (the compressed case).
+func (r *MshBReader) Close() error {
+	if r.f != nil {
+		return r.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildLineNurbs makes a trivial degree-1 curve through two unit-weight control points,
+// just enough geometry for the binary encode/decode round trip to exercise.
+func buildLineNurbs(x0, x1 [3]float64) *Nurbs {
+	o := new(Nurbs)
+	o.Init(1, []int{1, 0, 0}, [][]float64{{0, 0, 1, 1}})
+	ctrls := [][]float64{
+		{x0[0], x0[1], x0[2], 1},
+		{x1[0], x1[1], x1[2], 1},
+	}
+	o.SetControl(ctrls, []int{0, 1})
+	return o
+}
+
+func checkLineNurbs(t *testing.T, o *Nurbs, x0, x1 [3]float64) {
+	t.Helper()
+	for i, want := range [][3]float64{x0, x1} {
+		x := o.GetQ(i, 0, 0)
+		for d := 0; d < 3; d++ {
+			if math.Abs(x[d]-want[d]) > 1e-12 {
+				t.Fatalf("control point %d: got %v, want %v", i, x, want)
+			}
+		}
+	}
+}
+
+// TestMshBRoundTrip covers WriteMshB/ReadMshB for both the uncompressed and the
+// Snappy-compressed payload path, with two NURBS so ids/offsets are exercised.
+func TestMshBRoundTrip(t *testing.T) {
+	a := buildLineNurbs([3]float64{0, 0, 0}, [3]float64{1, 0, 0})
+	b := buildLineNurbs([3]float64{0, 1, 0}, [3]float64{1, 1, 0})
+	nurbss := []*Nurbs{a, b}
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		if err := WriteMshB(dir, "mesh", nurbss, compress); err != nil {
+			t.Fatalf("compress=%v: WriteMshB failed: %v", compress, err)
+		}
+		got, err := ReadMshB(filepath.Join(dir, "mesh"))
+		if err != nil {
+			t.Fatalf("compress=%v: ReadMshB failed: %v", compress, err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("compress=%v: expected 2 NURBS, got %d", compress, len(got))
+		}
+		checkLineNurbs(t, got[0], [3]float64{0, 0, 0}, [3]float64{1, 0, 0})
+		checkLineNurbs(t, got[1], [3]float64{0, 1, 0}, [3]float64{1, 1, 0})
+	}
+}
+
+// TestReadMshBOne checks that a single NURBS can be read back by id without decoding
+// the rest of the file.
+func TestReadMshBOne(t *testing.T) {
+	a := buildLineNurbs([3]float64{0, 0, 0}, [3]float64{1, 0, 0})
+	b := buildLineNurbs([3]float64{0, 1, 0}, [3]float64{1, 1, 0})
+	dir := t.TempDir()
+	if err := WriteMshB(dir, "mesh", []*Nurbs{a, b}, false); err != nil {
+		t.Fatalf("WriteMshB failed: %v", err)
+	}
+	o, err := ReadMshBOne(filepath.Join(dir, "mesh"), 1)
+	if err != nil {
+		t.Fatalf("ReadMshBOne failed: %v", err)
+	}
+	checkLineNurbs(t, o, [3]float64{0, 1, 0}, [3]float64{1, 1, 0})
+
+	if _, err := ReadMshBOne(filepath.Join(dir, "mesh"), 7); err == nil {
+		t.Fatalf("expected an error for a non-existent id, got nil")
+	}
+}
+
+// TestMshBReaderStreams checks that MshBReader.Next yields every NURBS in order,
+// terminating with io.EOF, for both the uncompressed (seek-based) and the compressed
+// (in-memory fallback) path.
+func TestMshBReaderStreams(t *testing.T) {
+	a := buildLineNurbs([3]float64{0, 0, 0}, [3]float64{1, 0, 0})
+	b := buildLineNurbs([3]float64{0, 1, 0}, [3]float64{1, 1, 0})
+	c := buildLineNurbs([3]float64{0, 2, 0}, [3]float64{1, 2, 0})
+	nurbss := []*Nurbs{a, b, c}
+	want := [][2][3]float64{
+		{{0, 0, 0}, {1, 0, 0}},
+		{{0, 1, 0}, {1, 1, 0}},
+		{{0, 2, 0}, {1, 2, 0}},
+	}
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		if err := WriteMshB(dir, "mesh", nurbss, compress); err != nil {
+			t.Fatalf("compress=%v: WriteMshB failed: %v", compress, err)
+		}
+		r, err := OpenMshB(filepath.Join(dir, "mesh"))
+		if err != nil {
+			t.Fatalf("compress=%v: OpenMshB failed: %v", compress, err)
+		}
+		for i, w := range want {
+			id, o, nerr := r.Next()
+			if nerr != nil {
+				t.Fatalf("compress=%v: Next() #%d failed: %v", compress, i, nerr)
+			}
+			if id != i {
+				t.Fatalf("compress=%v: Next() #%d: got id=%d, want %d", compress, i, id, i)
+			}
+			checkLineNurbs(t, o, w[0], w[1])
+		}
+		if _, _, err := r.Next(); err != io.EOF {
+			t.Fatalf("compress=%v: expected io.EOF after the last record, got %v", compress, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("compress=%v: Close failed: %v", compress, err)
+		}
+	}
+}
+
+// TestMshBCorruptEntryErrors checks that a table-of-contents entry whose offset/length
+// run past the end of the data section is rejected with an error -- not a slice-bounds
+// panic -- by every path that reads one: ReadMshB, ReadMshBOne and MshBReader.Next.
+func TestMshBCorruptEntryErrors(t *testing.T) {
+	a := buildLineNurbs([3]float64{0, 0, 0}, [3]float64{1, 0, 0})
+	dir := t.TempDir()
+	if err := WriteMshB(dir, "mesh", []*Nurbs{a}, false); err != nil {
+		t.Fatalf("WriteMshB failed: %v", err)
+	}
+	fn := filepath.Join(dir, "mesh.mshb")
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	// the one TOC entry starts right after magic(8)+version(1)+flags(1)+nEntries(4); its
+	// Length field is the last 8 bytes of the (Id int32, Offset int64, Length int64)
+	// record, so setting its low 7 bytes to 0xff (the top byte stays 0, keeping the value
+	// positive) turns it into a huge length that pushes it past EOF.
+	lenOff := len(mshbMagic) + 1 + 1 + 4 + 4 + 8
+	for i := 0; i < 7; i++ {
+		buf[lenOff+i] = 0xff
+	}
+	if err := os.WriteFile(fn, buf, 0644); err != nil {
+		t.Fatalf("failed to write corrupted fixture: %v", err)
+	}
+
+	if _, err := ReadMshB(filepath.Join(dir, "mesh")); err == nil {
+		t.Fatalf("ReadMshB: expected an error on a corrupted entry, got nil")
+	}
+	if _, err := ReadMshBOne(filepath.Join(dir, "mesh"), 0); err == nil {
+		t.Fatalf("ReadMshBOne: expected an error on a corrupted entry, got nil")
+	}
+	r, err := OpenMshB(filepath.Join(dir, "mesh"))
+	if err != nil {
+		t.Fatalf("OpenMshB failed: %v", err)
+	}
+	defer r.Close()
+	if _, _, err := r.Next(); err == nil {
+		t.Fatalf("MshBReader.Next: expected an error on a corrupted entry, got nil")
+	}
+}
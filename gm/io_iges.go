@@ -0,0 +1,321 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/gosl/utl"
+)
+
+// IGES entity types handled by ReadIGES
+const (
+	igesTypeBSplineCurve   = 126 // rational B-spline curve
+	igesTypeBSplineSurface = 128 // rational B-spline surface
+	igesTypeCurveOnSurface = 142 // trimming curve lying on a surface
+	igesTypeTrimmedSurface = 144 // surface trimmed by curves
+)
+
+// TrimCurve records an IGES trimming entity (142 curve-on-surface or 144 trimmed
+// surface) that ReadIGESFull found but did not apply to the geometry. Callers that need
+// the trim can parse Raw themselves; Seq is the directory-entry sequence number of the
+// trimmed surface this entity refers to.
+type TrimCurve struct {
+	Seq  int    // directory-entry sequence number of the owning surface
+	Form int    // IGES form number of the trimming entity
+	Raw  string // unparsed parameter-data record
+}
+
+// igesDE is one Directory Entry (two physical 80-column lines in the file)
+type igesDE struct {
+	seq   int // sequence number of this entry's first line (what Parameter Data back-points to)
+	etype int
+	form  int
+}
+
+// ReadIGES imports NURBS curves (entity 126) and surfaces (entity 128) from an IGES
+// exchange file, mapping knots, weights and control points directly into the Nurbs
+// representation used elsewhere in this package. IGES already stores knot vectors at
+// full multiplicity, so no expansion is needed (c.f. ReadSTEP, which does expand
+// multiplicities). Trimming entities (142/144) are recorded but not applied; see
+// ReadIGESFull.
+func ReadIGES(fn string) (nurbss []*Nurbs, err error) {
+	nurbss, _, err = ReadIGESFull(fn)
+	return
+}
+
+// ReadIGESFull is ReadIGES plus the trimming-curve entities found in the file, keyed by
+// the directory-entry sequence number of the surface each one trims.
+func ReadIGESFull(fn string) (nurbss []*Nurbs, trims map[int][]TrimCurve, err error) {
+
+	// split into directory-entry and parameter-data sections (cols 73-80 hold the code)
+	lines, err := readTextLines(fn)
+	if err != nil {
+		return
+	}
+	var dLines, pLines []string
+	for _, l := range lines {
+		if len(l) < 73 {
+			continue
+		}
+		switch l[72] {
+		case 'D':
+			dLines = append(dLines, l)
+		case 'P':
+			pLines = append(pLines, l)
+		}
+	}
+	des, err := parseIgesDirectory(dLines)
+	if err != nil {
+		return
+	}
+	pdata := parseIgesParamData(pLines)
+
+	// build NURBSs and collect trims
+	trims = make(map[int][]TrimCurve)
+	for _, de := range des {
+		raw := pdata[de.seq]
+		switch de.etype {
+		case igesTypeBSplineCurve:
+			var o *Nurbs
+			if o, err = parseIges126(raw); err != nil {
+				return nil, nil, fmt.Errorf("ReadIGES: entity 126 (DE=%d): %v", de.seq, err)
+			}
+			nurbss = append(nurbss, o)
+		case igesTypeBSplineSurface:
+			var o *Nurbs
+			if o, err = parseIges128(raw); err != nil {
+				return nil, nil, fmt.Errorf("ReadIGES: entity 128 (DE=%d): %v", de.seq, err)
+			}
+			nurbss = append(nurbss, o)
+		case igesTypeCurveOnSurface, igesTypeTrimmedSurface:
+			// the owning surface's DE pointer is SPTR (2nd parameter) of a 142, PTS (1st) of a 144
+			f := splitIgesParams(raw)
+			ptr := 1
+			if de.etype == igesTypeTrimmedSurface {
+				ptr = 0
+			}
+			if ptr >= len(f) {
+				return nil, nil, fmt.Errorf("ReadIGES: entity %d (DE=%d) has too few parameters", de.etype, de.seq)
+			}
+			var surf int
+			if surf, err = igesInt(f[ptr]); err != nil {
+				return nil, nil, fmt.Errorf("ReadIGES: entity %d (DE=%d): %v", de.etype, de.seq, err)
+			}
+			trims[surf] = append(trims[surf], TrimCurve{Seq: surf, Form: de.form, Raw: raw})
+		}
+	}
+	return
+}
+
+// parseIgesDirectory reads pairs of 80-column Directory Entry lines
+func parseIgesDirectory(lines []string) (des []igesDE, err error) {
+	for i := 0; i+1 < len(lines); i += 2 {
+		l1, l2 := lines[i], lines[i+1]
+		if len(l1) < 16 || len(l2) < 40 {
+			return nil, fmt.Errorf("parseIgesDirectory: malformed directory entry at line %d", i+1)
+		}
+		etype, err1 := igesInt(l1[0:8])
+		if err1 != nil {
+			return nil, err1
+		}
+		form, err2 := igesInt(l2[32:40])
+		if err2 != nil {
+			form = 0
+		}
+		des = append(des, igesDE{seq: i + 1, etype: etype, form: form})
+	}
+	return
+}
+
+// parseIgesParamData groups Parameter Data lines by the Directory Entry sequence number
+// in their back-pointer field (columns 65-72) and concatenates each group's data
+// (columns 1-64) into a single comma-separated parameter string
+func parseIgesParamData(lines []string) map[int]string {
+	groups := make(map[int][]string)
+	for _, l := range lines {
+		for len(l) < 80 {
+			l += " "
+		}
+		back, err := igesInt(l[64:72])
+		if err != nil {
+			continue
+		}
+		groups[back] = append(groups[back], strings.TrimRight(l[0:64], " "))
+	}
+	out := make(map[int]string, len(groups))
+	for seq, parts := range groups {
+		out[seq] = strings.Join(parts, "")
+	}
+	return out
+}
+
+// parseIges126 builds a NURBS curve from an IGES entity 126 parameter record
+func parseIges126(raw string) (o *Nurbs, err error) {
+	f := splitIgesParams(raw)
+	if len(f) < 6 {
+		return nil, fmt.Errorf("entity 126 has too few parameters")
+	}
+	k, err := igesInt(f[0])
+	if err != nil {
+		return
+	}
+	m, err := igesInt(f[1])
+	if err != nil {
+		return
+	}
+	pos := 6
+	nknots := k + m + 2
+	knots := make([]float64, nknots)
+	for i := range knots {
+		if knots[i], err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+	}
+	nctrl := k + 1
+	weights := make([]float64, nctrl)
+	for i := range weights {
+		if weights[i], err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+	}
+	ctrls := make([][]float64, nctrl)
+	for i := range ctrls {
+		var x, y, z float64
+		if x, err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+		if y, err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+		if z, err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+		ctrls[i] = []float64{x, y, z, weights[i]}
+	}
+	o = new(Nurbs)
+	o.Init(1, []int{m, 0, 0}, [][]float64{knots})
+	ids := make([]int, nctrl)
+	for i := range ids {
+		ids[i] = i
+	}
+	o.SetControl(ctrls, ids)
+	return
+}
+
+// parseIges128 builds a NURBS surface from an IGES entity 128 parameter record
+func parseIges128(raw string) (o *Nurbs, err error) {
+	f := splitIgesParams(raw)
+	if len(f) < 9 {
+		return nil, fmt.Errorf("entity 128 has too few parameters")
+	}
+	k1, err := igesInt(f[0])
+	if err != nil {
+		return
+	}
+	k2, err := igesInt(f[1])
+	if err != nil {
+		return
+	}
+	m1, err := igesInt(f[2])
+	if err != nil {
+		return
+	}
+	m2, err := igesInt(f[3])
+	if err != nil {
+		return
+	}
+	pos := 9
+	n1 := k1 + m1 + 2
+	knots1 := make([]float64, n1)
+	for i := range knots1 {
+		if knots1[i], err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+	}
+	n2 := k2 + m2 + 2
+	knots2 := make([]float64, n2)
+	for i := range knots2 {
+		if knots2[i], err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+	}
+	nctrl := (k1 + 1) * (k2 + 1)
+	weights := make([]float64, nctrl)
+	for i := range weights {
+		if weights[i], err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+	}
+	ctrls := make([][]float64, nctrl)
+	for i := range ctrls {
+		var x, y, z float64
+		if x, err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+		if y, err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+		if z, err = igesFloat(f[pos]); err != nil {
+			return
+		}
+		pos++
+		ctrls[i] = []float64{x, y, z, weights[i]}
+	}
+	o = new(Nurbs)
+	o.Init(2, []int{m1, m2, 0}, [][]float64{knots1, knots2})
+	ids := make([]int, nctrl)
+	for i := range ids {
+		ids[i] = i
+	}
+	o.SetControl(ctrls, ids)
+	return
+}
+
+// splitIgesParams splits a ';'-terminated, comma-separated IGES parameter-data record
+func splitIgesParams(s string) []string {
+	s = strings.TrimSuffix(strings.TrimSpace(s), ";")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// igesFloat parses an IGES real number, which may use Fortran-style 'D' exponents
+func igesFloat(s string) (float64, error) {
+	s = strings.NewReplacer("D", "E", "d", "E").Replace(strings.TrimSpace(s))
+	return strconv.ParseFloat(s, 64)
+}
+
+// igesInt parses an IGES integer field (tolerating a trailing '.' from real-as-int use)
+func igesInt(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	v, err := strconv.ParseFloat(s, 64)
+	return int(v), err
+}
+
+// readTextLines reads fn and splits it into lines, also used by ReadSTEP
+func readTextLines(fn string) (lines []string, err error) {
+	buf, err := utl.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(buf), "\n") {
+		lines = append(lines, strings.TrimRight(l, "\r"))
+	}
+	return
+}
@@ -0,0 +1,100 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// igesDELine builds one 80-column IGES Directory Entry line; content occupies columns
+// 1-72 (padded on the right with spaces), column 73 is always 'D', and the trailing sequence
+// number fills columns 74-80, matching the fixed-width layout ReadIGES expects.
+func igesDELine(content string, seq int) string {
+	for len(content) < 72 {
+		content += " "
+	}
+	return content[:72] + "D" + fmt.Sprintf("%7d", seq)
+}
+
+// igesPLine builds one 80-column IGES Parameter Data line: columns 1-64 hold the
+// comma-separated parameter text, columns 65-72 the back-pointer to the owning
+// Directory Entry sequence number, column 73 is 'P'.
+func igesPLine(params string, deSeq, seq int) string {
+	for len(params) < 64 {
+		params += " "
+	}
+	return params[:64] + fmt.Sprintf("%8d", deSeq) + "P" + fmt.Sprintf("%7d", seq)
+}
+
+// writeMinimalIgesLine126 writes an IGES file holding a single degree-1 entity 126
+// curve through two unit-weight control points (0,0,0) and (1,0,0).
+func writeMinimalIgesLine126(t *testing.T, fn string) {
+	t.Helper()
+	de1 := igesDELine("     126", 1)
+	de2 := igesDELine(strings.Repeat(" ", 24)+"       0", 2)
+	params := strings.Join([]string{
+		"1", "1", // K (last control point index), M (degree)
+		"0", "0", "0", "0", // planar, closed, rational, periodic flags
+		"0", "0", "1", "1", // knots: full multiplicity at both ends
+		"1", "1", // weights
+		"0", "0", "0", // control point 0
+		"1", "0", "0", // control point 1
+	}, ",") + ";"
+	p1 := igesPLine(params, 1, 1)
+	content := strings.Join([]string{de1, de2, p1}, "\n") + "\n"
+	if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write fixture IGES file: %v", err)
+	}
+}
+
+// TestReadIGESLine checks that a minimal entity 126 curve round-trips through ReadIGES
+// into the expected NURBS, and that writing it back out via WriteMshD and reading it
+// back with ReadMsh reproduces the same control points (the "round-trip to .msh" the
+// ReadIGES/ReadSTEP request called for).
+func TestReadIGESLine(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "line.igs")
+	writeMinimalIgesLine126(t, fn)
+
+	nurbss, err := ReadIGES(fn)
+	if err != nil {
+		t.Fatalf("ReadIGES failed: %v", err)
+	}
+	if len(nurbss) != 1 {
+		t.Fatalf("expected 1 NURBS, got %d", len(nurbss))
+	}
+	o := nurbss[0]
+	if o.gnd != 1 || o.p[0] != 1 {
+		t.Fatalf("expected a degree-1 curve, got gnd=%d p=%d", o.gnd, o.p[0])
+	}
+	want := [][4]float64{{0, 0, 0, 1}, {1, 0, 0, 1}}
+	for i, w := range want {
+		x := o.GetQ(i, 0, 0)
+		for d := 0; d < 4; d++ {
+			if math.Abs(x[d]-w[d]) > 1e-12 {
+				t.Fatalf("control point %d: got %v, want %v", i, x, w)
+			}
+		}
+	}
+
+	WriteMshD(dir, "line", nurbss, nil, nil)
+	got := ReadMsh(filepath.Join(dir, "line"))
+	if len(got) != 1 {
+		t.Fatalf("ReadMsh: expected 1 NURBS, got %d", len(got))
+	}
+	for i, w := range want {
+		x := got[0].GetQ(i, 0, 0)
+		for d := 0; d < 4; d++ {
+			if math.Abs(x[d]-w[d]) > 1e-12 {
+				t.Fatalf("round-tripped control point %d: got %v, want %v", i, x, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/gosl/utl"
+)
+
+// ReadSTEP imports NURBS curves and surfaces from a STEP (ISO-10303-21, AP203/AP214)
+// exchange file, reading B_SPLINE_CURVE_WITH_KNOTS and B_SPLINE_SURFACE_WITH_KNOTS
+// entities (plus the RATIONAL_B_SPLINE_CURVE/SURFACE complex-entity parts that carry
+// weights, when present) into the Nurbs representation used elsewhere in this package.
+// Unlike IGES, STEP stores knots as distinct values with separate multiplicities, so
+// they're expanded here into the full per-knot vector. Trimming entities are recorded
+// but not applied; see ReadSTEPFull.
+func ReadSTEP(fn string) (nurbss []*Nurbs, err error) {
+	nurbss, _, err = ReadSTEPFull(fn)
+	return
+}
+
+// ReadSTEPFull is ReadSTEP plus the raw text of any trimming entities found
+// (TRIMMED_CURVE, FACE_BOUND, FACE_OUTER_BOUND), keyed by their STEP instance id.
+func ReadSTEPFull(fn string) (nurbss []*Nurbs, trims map[int]string, err error) {
+	instances, err := stepReadInstances(fn)
+	if err != nil {
+		return
+	}
+
+	// resolve every CARTESIAN_POINT up front so curves/surfaces can look up control points
+	points := make(map[int][]float64)
+	for id, text := range instances {
+		if xyz, ok := stepParsePoint(text); ok {
+			points[id] = xyz
+		}
+	}
+
+	// process the rest in id order so multi-patch output is deterministic
+	ids := make([]int, 0, len(instances))
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	trims = make(map[int]string)
+	for _, id := range ids {
+		text := instances[id]
+		switch {
+		case strings.Contains(text, "B_SPLINE_CURVE_WITH_KNOTS"):
+			var o *Nurbs
+			if o, err = stepParseCurve(text, points); err != nil {
+				return nil, nil, fmt.Errorf("ReadSTEP: #%d: %v", id, err)
+			}
+			nurbss = append(nurbss, o)
+		case strings.Contains(text, "B_SPLINE_SURFACE_WITH_KNOTS"):
+			var o *Nurbs
+			if o, err = stepParseSurface(text, points); err != nil {
+				return nil, nil, fmt.Errorf("ReadSTEP: #%d: %v", id, err)
+			}
+			nurbss = append(nurbss, o)
+		case strings.Contains(text, "TRIMMED_CURVE"),
+			strings.Contains(text, "FACE_OUTER_BOUND"),
+			strings.Contains(text, "FACE_BOUND"):
+			trims[id] = text
+		}
+	}
+	return
+}
+
+// stepReadInstances splits a STEP file's DATA section into "#id = ...;" instances,
+// keyed by id, with comments stripped. Simple and complex entity instances (the latter
+// concatenating several "KEYWORD(args)" groups under one id) are both returned as-is;
+// callers pick the parts they need out of the text with stepExtractArgs.
+func stepReadInstances(fn string) (instances map[int]string, err error) {
+	buf, err := utl.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	content := stepStripComments(string(buf))
+	instances = make(map[int]string)
+	for _, stmt := range strings.Split(content, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if !strings.HasPrefix(stmt, "#") {
+			continue
+		}
+		eq := strings.Index(stmt, "=")
+		if eq < 0 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(stmt[1:eq]))
+		if err != nil {
+			continue
+		}
+		instances[id] = strings.TrimSpace(stmt[eq+1:])
+	}
+	return
+}
+
+// stepStripComments removes STEP's "/* ... */" comments
+func stepStripComments(s string) string {
+	for {
+		i := strings.Index(s, "/*")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i:], "*/")
+		if j < 0 {
+			return s[:i]
+		}
+		s = s[:i] + s[i+j+2:]
+	}
+	return s
+}
+
+// stepParsePoint extracts x,y,z from a CARTESIAN_POINT('name',(x,y,z)) instance
+func stepParsePoint(text string) (xyz []float64, ok bool) {
+	args, found := stepExtractArgs(text, "CARTESIAN_POINT")
+	if !found {
+		return nil, false
+	}
+	parts := stepSplitTopLevel(args)
+	if len(parts) < 2 {
+		return nil, false
+	}
+	vals, err := stepParseFloatList(parts[1])
+	if err != nil || len(vals) < 3 {
+		return nil, false
+	}
+	return vals, true
+}
+
+// stepParseCurve builds a NURBS curve out of the B_SPLINE_CURVE and
+// B_SPLINE_CURVE_WITH_KNOTS parts of a (possibly complex) STEP entity instance
+func stepParseCurve(text string, points map[int][]float64) (o *Nurbs, err error) {
+	knotArgs, ok := stepExtractArgs(text, "B_SPLINE_CURVE_WITH_KNOTS")
+	if !ok {
+		return nil, fmt.Errorf("missing B_SPLINE_CURVE_WITH_KNOTS")
+	}
+	baseArgs, ok := stepExtractArgs(text, "B_SPLINE_CURVE")
+	if !ok {
+		return nil, fmt.Errorf("missing B_SPLINE_CURVE")
+	}
+
+	bparts := stepSplitTopLevel(baseArgs)
+	if len(bparts) < 2 {
+		return nil, fmt.Errorf("malformed B_SPLINE_CURVE")
+	}
+	degree, err := strconv.Atoi(strings.TrimSpace(bparts[0]))
+	if err != nil {
+		return nil, err
+	}
+	ptRefs, err := stepParseRefList(bparts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	kparts := stepSplitTopLevel(knotArgs)
+	if len(kparts) < 2 {
+		return nil, fmt.Errorf("malformed B_SPLINE_CURVE_WITH_KNOTS")
+	}
+	mult, err := stepParseIntList(kparts[0])
+	if err != nil {
+		return nil, err
+	}
+	kvals, err := stepParseFloatList(kparts[1])
+	if err != nil {
+		return nil, err
+	}
+	knots := stepExpandKnots(mult, kvals)
+
+	weights := make([]float64, len(ptRefs))
+	for i := range weights {
+		weights[i] = 1
+	}
+	if wArgs, ok := stepExtractArgs(text, "RATIONAL_B_SPLINE_CURVE"); ok {
+		if w, werr := stepParseFloatList(wArgs); werr == nil && len(w) == len(ptRefs) {
+			weights = w
+		}
+	}
+
+	ctrls := make([][]float64, len(ptRefs))
+	for i, id := range ptRefs {
+		xyz, ok := points[id]
+		if !ok {
+			return nil, fmt.Errorf("unresolved control point #%d", id)
+		}
+		ctrls[i] = []float64{xyz[0], xyz[1], xyz[2], weights[i]}
+	}
+
+	o = new(Nurbs)
+	o.Init(1, []int{degree, 0, 0}, [][]float64{knots})
+	ids := make([]int, len(ctrls))
+	for i := range ids {
+		ids[i] = i
+	}
+	o.SetControl(ctrls, ids)
+	return
+}
+
+// stepParseSurface builds a NURBS surface out of the B_SPLINE_SURFACE and
+// B_SPLINE_SURFACE_WITH_KNOTS parts of a (possibly complex) STEP entity instance. The
+// control-point list is indexed [u-row][v-col], matching the order the rest of this
+// package flattens control grids in (u fastest).
+func stepParseSurface(text string, points map[int][]float64) (o *Nurbs, err error) {
+	knotArgs, ok := stepExtractArgs(text, "B_SPLINE_SURFACE_WITH_KNOTS")
+	if !ok {
+		return nil, fmt.Errorf("missing B_SPLINE_SURFACE_WITH_KNOTS")
+	}
+	baseArgs, ok := stepExtractArgs(text, "B_SPLINE_SURFACE")
+	if !ok {
+		return nil, fmt.Errorf("missing B_SPLINE_SURFACE")
+	}
+
+	bparts := stepSplitTopLevel(baseArgs)
+	if len(bparts) < 3 {
+		return nil, fmt.Errorf("malformed B_SPLINE_SURFACE")
+	}
+	du, err := strconv.Atoi(strings.TrimSpace(bparts[0]))
+	if err != nil {
+		return nil, err
+	}
+	dv, err := strconv.Atoi(strings.TrimSpace(bparts[1]))
+	if err != nil {
+		return nil, err
+	}
+	rows := stepSplitTopLevel(stepStripOuterParens(strings.TrimSpace(bparts[2])))
+	nu := len(rows)
+	var nv int
+	refRows := make([][]int, nu)
+	for i, row := range rows {
+		refs, rerr := stepParseRefList(row)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if i == 0 {
+			nv = len(refs)
+		} else if len(refs) != nv {
+			return nil, fmt.Errorf("ragged control point grid")
+		}
+		refRows[i] = refs
+	}
+
+	kparts := stepSplitTopLevel(knotArgs)
+	if len(kparts) < 4 {
+		return nil, fmt.Errorf("malformed B_SPLINE_SURFACE_WITH_KNOTS")
+	}
+	umult, err := stepParseIntList(kparts[0])
+	if err != nil {
+		return nil, err
+	}
+	vmult, err := stepParseIntList(kparts[1])
+	if err != nil {
+		return nil, err
+	}
+	uvals, err := stepParseFloatList(kparts[2])
+	if err != nil {
+		return nil, err
+	}
+	vvals, err := stepParseFloatList(kparts[3])
+	if err != nil {
+		return nil, err
+	}
+	uknots := stepExpandKnots(umult, uvals)
+	vknots := stepExpandKnots(vmult, vvals)
+
+	weights := make([][]float64, nu)
+	for i := range weights {
+		weights[i] = make([]float64, nv)
+		for j := range weights[i] {
+			weights[i][j] = 1
+		}
+	}
+	if wArgs, ok := stepExtractArgs(text, "RATIONAL_B_SPLINE_SURFACE"); ok {
+		wrows := stepSplitTopLevel(stepStripOuterParens(strings.TrimSpace(wArgs)))
+		if len(wrows) == nu {
+			parsed := make([][]float64, nu)
+			good := true
+			for i, row := range wrows {
+				w, werr := stepParseFloatList(row)
+				if werr != nil || len(w) != nv {
+					good = false
+					break
+				}
+				parsed[i] = w
+			}
+			if good {
+				weights = parsed
+			}
+		}
+	}
+
+	ctrls := make([][]float64, nu*nv)
+	for j := 0; j < nv; j++ {
+		for i := 0; i < nu; i++ {
+			xyz, ok := points[refRows[i][j]]
+			if !ok {
+				return nil, fmt.Errorf("unresolved control point #%d", refRows[i][j])
+			}
+			ctrls[j*nu+i] = []float64{xyz[0], xyz[1], xyz[2], weights[i][j]}
+		}
+	}
+
+	o = new(Nurbs)
+	o.Init(2, []int{du, dv, 0}, [][]float64{uknots, vknots})
+	ids := make([]int, len(ctrls))
+	for i := range ids {
+		ids[i] = i
+	}
+	o.SetControl(ctrls, ids)
+	return
+}
+
+// stepExtractArgs returns the parenthesised argument list following the first
+// occurrence of "KEYWORD(" in text, handling one or more levels of nested parens. This
+// is how the constituent parts of a STEP complex entity instance (several
+// "KEYWORD(args)" groups concatenated under one id) are picked apart.
+func stepExtractArgs(text, keyword string) (args string, ok bool) {
+	idx := strings.Index(text, keyword+"(")
+	if idx < 0 {
+		return "", false
+	}
+	start := idx + len(keyword) + 1
+	depth := 1
+	i := start
+	for ; i < len(text) && depth > 0; i++ {
+		switch text[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+	}
+	if depth != 0 {
+		return "", false
+	}
+	return text[start : i-1], true
+}
+
+// stepStripOuterParens removes exactly one matching "(...)" pair wrapping s, if
+// present. Unlike strings.Trim(s,"()"), which trims every leading/trailing byte in the
+// cutset, this only strips a single layer -- needed for list-of-lists arguments like
+// control_points_list "((#1,#2),(#3,#4))", where Trim would also eat the inner parens
+// at the string's own boundary and corrupt the nested rows.
+func stepStripOuterParens(s string) string {
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// stepSplitTopLevel splits s on commas that are not nested inside parentheses
+func stepSplitTopLevel(s string) (parts []string) {
+	depth := 0
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[last:])
+	return
+}
+
+// stepParseIntList parses a "(m1,m2,...)" STEP list of integers
+func stepParseIntList(s string) (vals []int, err error) {
+	s = strings.Trim(strings.TrimSpace(s), "()")
+	if s == "" {
+		return nil, nil
+	}
+	for _, p := range stepSplitTopLevel(s) {
+		v, e := strconv.Atoi(strings.TrimSpace(p))
+		if e != nil {
+			return nil, e
+		}
+		vals = append(vals, v)
+	}
+	return
+}
+
+// stepParseFloatList parses a "(v1,v2,...)" STEP list of reals
+func stepParseFloatList(s string) (vals []float64, err error) {
+	s = strings.Trim(strings.TrimSpace(s), "()")
+	if s == "" {
+		return nil, nil
+	}
+	for _, p := range stepSplitTopLevel(s) {
+		v, e := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if e != nil {
+			return nil, e
+		}
+		vals = append(vals, v)
+	}
+	return
+}
+
+// stepParseRefList parses a "(#1,#2,...)" STEP list of entity references
+func stepParseRefList(s string) (ids []int, err error) {
+	s = strings.Trim(strings.TrimSpace(s), "()")
+	if s == "" {
+		return nil, nil
+	}
+	for _, p := range stepSplitTopLevel(s) {
+		p = strings.TrimSpace(p)
+		id, e := strconv.Atoi(strings.TrimPrefix(p, "#"))
+		if e != nil {
+			return nil, e
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// stepExpandKnots expands STEP's (distinct values, multiplicities) knot encoding into
+// the full per-knot vector used by Nurbs
+func stepExpandKnots(mult []int, vals []float64) (knots []float64) {
+	for i, m := range mult {
+		for j := 0; j < m; j++ {
+			knots = append(knots, vals[i])
+		}
+	}
+	return
+}
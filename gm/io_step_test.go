@@ -0,0 +1,86 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMinimalStepSurface writes a STEP file holding a single bilinear (degree-1,
+// 2x2 control point) B_SPLINE_SURFACE_WITH_KNOTS entity, as a complex instance whose
+// B_SPLINE_SURFACE_WITH_KNOTS and B_SPLINE_SURFACE parts are concatenated the way
+// AP214 writes them. control_points_list is nested ("((#1,#2),(#3,#4))"), which is
+// what exercises stepStripOuterParens: stripping it with strings.Trim instead would
+// corrupt the inner rows.
+func writeMinimalStepSurface(t *testing.T, fn string) {
+	t.Helper()
+	const entity = "B_SPLINE_SURFACE_WITH_KNOTS((2,2),(2,2),(0.,1.),(0.,1.),.UNSPECIFIED.)" +
+		"B_SPLINE_SURFACE(1,1,((#1,#2),(#3,#4)),.UNSPECIFIED.,.F.,.F.,.F.)"
+	content := "#1=CARTESIAN_POINT('P1',(0.,0.,0.));\n" +
+		"#2=CARTESIAN_POINT('P2',(1.,0.,0.));\n" +
+		"#3=CARTESIAN_POINT('P3',(2.,0.,0.));\n" +
+		"#4=CARTESIAN_POINT('P4',(3.,0.,0.));\n" +
+		"#5=" + entity + ";\n"
+	if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write fixture STEP file: %v", err)
+	}
+}
+
+// TestReadSTEPSurface checks that a minimal bilinear surface, whose control point
+// grid is a nested STEP list, is assembled into the right (u,v) control net -- the
+// case where stripping the list-of-lists parens with strings.Trim (instead of exactly
+// one outer layer) used to corrupt the inner rows and break ReadSTEP surface import
+// outright -- and that it round-trips through WriteMshD/ReadMsh.
+func TestReadSTEPSurface(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "surf.stp")
+	writeMinimalStepSurface(t, fn)
+
+	nurbss, err := ReadSTEP(fn)
+	if err != nil {
+		t.Fatalf("ReadSTEP failed: %v", err)
+	}
+	if len(nurbss) != 1 {
+		t.Fatalf("expected 1 NURBS, got %d", len(nurbss))
+	}
+	o := nurbss[0]
+	if o.gnd != 2 || o.p[0] != 1 || o.p[1] != 1 {
+		t.Fatalf("expected a degree-(1,1) surface, got gnd=%d p=%v", o.gnd, o.p)
+	}
+	if o.n[0] != 2 || o.n[1] != 2 {
+		t.Fatalf("expected a 2x2 control net, got n=%v", o.n)
+	}
+	want := map[[2]int][4]float64{
+		{0, 0}: {0, 0, 0, 1},
+		{1, 0}: {2, 0, 0, 1},
+		{0, 1}: {1, 0, 0, 1},
+		{1, 1}: {3, 0, 0, 1},
+	}
+	for ij, w := range want {
+		x := o.GetQ(ij[0], ij[1], 0)
+		for d := 0; d < 4; d++ {
+			if math.Abs(x[d]-w[d]) > 1e-12 {
+				t.Fatalf("control point %v: got %v, want %v", ij, x, w)
+			}
+		}
+	}
+
+	WriteMshD(dir, "surf", nurbss, nil, nil)
+	got := ReadMsh(filepath.Join(dir, "surf"))
+	if len(got) != 1 {
+		t.Fatalf("ReadMsh: expected 1 NURBS, got %d", len(got))
+	}
+	for ij, w := range want {
+		x := got[0].GetQ(ij[0], ij[1], 0)
+		for d := 0; d < 4; d++ {
+			if math.Abs(x[d]-w[d]) > 1e-12 {
+				t.Fatalf("round-tripped control point %v: got %v, want %v", ij, x, w)
+			}
+		}
+	}
+}
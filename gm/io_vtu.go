@@ -0,0 +1,580 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+
+	"code.google.com/p/gosl/utl"
+)
+
+// VTK cell types used by WriteVTU (see VTK's vtkCellType.h)
+const (
+	vtkLine                = 3
+	vtkQuad                = 9
+	vtkHexahedron          = 12
+	vtkBezierCurve         = 75
+	vtkBezierQuadrilateral = 77
+	vtkBezierHexahedron    = 79
+)
+
+// TessOpts controls how WriteVTU tessellates NURBS geometry into VTK cells
+type TessOpts struct {
+	SamplesPerSpan int  // linear-refined subdivisions per knot span, per parametric direction: each element is sampled at SamplesPerSpan+1 points per direction (<=1 means "just the element corners"); ignored for elements emitted as VTK_BEZIER_* cells
+	Bezier         bool // emit higher-order VTK_BEZIER_* cells for elements whose element boundaries already have full knot multiplicity (a true Bezier mesh); elements that don't qualify fall back to linear sampling regardless of this flag
+	WithPointIds   bool // attach each point's HashPoint id as point data "ControlPointId" (Bezier cells only, since linear-sampled points aren't control points; those get -1)
+	WithTags       bool // attach each cell's patch id and local element id as cell data "PatchId"/"ElemId"
+	WithJacobian   bool // attach an approximate Jacobian (edge-vector determinant at the element's first corner) as cell data "Jacobian"
+	Binary         bool // encode data arrays as a single base64 "appended data" block instead of inline ASCII
+}
+
+// WriteVTU tessellates nurbss into a VTK XML unstructured grid (.vtu) for visualization
+// in ParaView/VisIt, closing the gap between the JSON .msh format and the viz ecosystem.
+// See TessOpts for the tessellation knobs.
+func WriteVTU(dirout, fnk string, nurbss []*Nurbs, opts *TessOpts) (err error) {
+	if opts == nil {
+		opts = &TessOpts{SamplesPerSpan: 1}
+	}
+
+	var points [][4]float64 // x,y,z,w
+	var cells [][]int
+	var cellTypes []int
+	var cellDegrees [][3]int // only meaningful for VTK_BEZIER_* cells, -1 otherwise
+	var cellPatch []int
+	var cellElem []int
+	var cellJac []float64
+
+	for sid, o := range nurbss {
+		elems := o.Elements()
+		for eid, e := range elems {
+			pts, conn, vtype, deg, bezier := tessellateElement(o, e, opts)
+			if len(conn) == 0 {
+				continue
+			}
+			base := len(points)
+			points = append(points, pts...)
+			for _, c := range conn {
+				shifted := make([]int, len(c))
+				for i, idx := range c {
+					shifted[i] = idx + base
+				}
+				cells = append(cells, shifted)
+				cellTypes = append(cellTypes, vtype)
+				if bezier {
+					cellDegrees = append(cellDegrees, deg)
+				} else {
+					cellDegrees = append(cellDegrees, [3]int{-1, -1, -1})
+				}
+				cellPatch = append(cellPatch, sid)
+				cellElem = append(cellElem, eid)
+				cellJac = append(cellJac, jacobianOfCell(points, shifted, o.gnd))
+			}
+		}
+	}
+
+	return writeVTUFile(dirout, fnk, points, cells, cellTypes, cellDegrees, cellPatch, cellElem, cellJac, opts)
+}
+
+// tessellateElement builds the VTK cell(s) for one NURBS element: a single higher-order
+// VTK_BEZIER_* cell when opts.Bezier is set and the element qualifies (full knot
+// multiplicity at both ends, in every direction), otherwise a linear-refined grid of
+// VTK_LINE/QUAD/HEXAHEDRON cells sampled at opts.SamplesPerSpan+1 points per span.
+func tessellateElement(o *Nurbs, span []int, opts *TessOpts) (points [][4]float64, cells [][]int, vtkType int, degree [3]int, bezier bool) {
+	if opts.Bezier {
+		if pts, conn, vtype, deg, ok := bezierElementCells(o, span); ok {
+			return pts, conn, vtype, deg, true
+		}
+	}
+	pts, conn, vtype := linearElementCells(o, span, opts.SamplesPerSpan)
+	return pts, conn, vtype, [3]int{-1, -1, -1}, false
+}
+
+// elementParamRange returns, for each parametric direction up to o.gnd, the [lo,hi]
+// knot interval of the element whose span indices (one per direction) are given
+func elementParamRange(o *Nurbs, span []int) (lo, hi [3]float64) {
+	for d := 0; d < o.gnd; d++ {
+		lo[d] = o.b[d].T[span[d]]
+		hi[d] = o.b[d].T[span[d]+1]
+	}
+	return
+}
+
+// paramAt returns the i-th of n equally spaced parameter values between lo and hi
+func paramAt(lo, hi float64, i, n int) float64 {
+	if n <= 1 {
+		return lo
+	}
+	return lo + (hi-lo)*float64(i)/float64(n-1)
+}
+
+// linearElementCells samples one element on a regular (samples+1)^gnd grid and
+// connects it into linear VTK_LINE/QUAD/HEXAHEDRON cells
+func linearElementCells(o *Nurbs, span []int, samples int) (points [][4]float64, cells [][]int, vtkType int) {
+	if samples < 1 {
+		samples = 1
+	}
+	lo, hi := elementParamRange(o, span)
+	n := samples + 1
+	dims := [3]int{1, 1, 1}
+	for d := 0; d < o.gnd; d++ {
+		dims[d] = n
+	}
+	idx := func(i, j, k int) int { return i + j*dims[0] + k*dims[0]*dims[1] }
+	points = make([][4]float64, dims[0]*dims[1]*dims[2])
+	u := make([]float64, 3)
+	for k := 0; k < dims[2]; k++ {
+		u[2] = paramAt(lo[2], hi[2], k, dims[2])
+		for j := 0; j < dims[1]; j++ {
+			u[1] = paramAt(lo[1], hi[1], j, dims[1])
+			for i := 0; i < dims[0]; i++ {
+				u[0] = paramAt(lo[0], hi[0], i, dims[0])
+				var x [4]float64
+				o.Point(x[:], u[:o.gnd])
+				points[idx(i, j, k)] = x
+			}
+		}
+	}
+	switch o.gnd {
+	case 1:
+		vtkType = vtkLine
+		for i := 0; i < dims[0]-1; i++ {
+			cells = append(cells, []int{idx(i, 0, 0), idx(i+1, 0, 0)})
+		}
+	case 2:
+		vtkType = vtkQuad
+		for j := 0; j < dims[1]-1; j++ {
+			for i := 0; i < dims[0]-1; i++ {
+				cells = append(cells, []int{idx(i, j, 0), idx(i+1, j, 0), idx(i+1, j+1, 0), idx(i, j+1, 0)})
+			}
+		}
+	case 3:
+		vtkType = vtkHexahedron
+		for k := 0; k < dims[2]-1; k++ {
+			for j := 0; j < dims[1]-1; j++ {
+				for i := 0; i < dims[0]-1; i++ {
+					cells = append(cells, []int{
+						idx(i, j, k), idx(i+1, j, k), idx(i+1, j+1, k), idx(i, j+1, k),
+						idx(i, j, k+1), idx(i+1, j, k+1), idx(i+1, j+1, k+1), idx(i, j+1, k+1),
+					})
+				}
+			}
+		}
+	}
+	return
+}
+
+// bezierElementCells emits a single VTK_BEZIER_* cell carrying the element's own
+// control points (and rational weights) directly, when the element is already a "pure"
+// Bezier piece -- i.e. every knot bounding it has multiplicity >= the degree in that
+// direction, so the element's local support is exactly one (p+1)^gnd window of the
+// global control net and no true Bezier-extraction blending is needed.
+//
+// VTK_BEZIER_* cells require VTK's higher-order point ordering (corners, then edges,
+// then faces, then interior -- see vtkHigherOrderCurve/Quadrilateral/Hexahedron's
+// PointIndexFromIJK), not the NURBS control net's tensor/lexicographic order, so the
+// points below are emitted directly in that order via vtkEdgePointOrder/
+// vtkQuadPointOrder/vtkHexPointOrder rather than a flat (i,j,k) scan.
+func bezierElementCells(o *Nurbs, span []int) (points [][4]float64, cells [][]int, vtkType int, degree [3]int, ok bool) {
+	for d := 0; d < o.gnd; d++ {
+		if knotMultiplicity(o.b[d].T, span[d]) < o.p[d] || knotMultiplicity(o.b[d].T, span[d]+1) < o.p[d] {
+			return nil, nil, 0, degree, false
+		}
+	}
+	lo := [3]int{0, 0, 0}
+	for d := 0; d < o.gnd; d++ {
+		lo[d] = span[d] - o.p[d]
+		degree[d] = o.p[d]
+	}
+	point := func(i, j, k int) [4]float64 {
+		x := o.GetQ(lo[0]+i, lo[1]+j, lo[2]+k)
+		return [4]float64{x[0], x[1], x[2], x[3]}
+	}
+	switch o.gnd {
+	case 1:
+		vtkType = vtkBezierCurve
+		for _, i := range vtkEdgePointOrder(o.p[0]) {
+			points = append(points, point(i, 0, 0))
+		}
+	case 2:
+		vtkType = vtkBezierQuadrilateral
+		for _, ij := range vtkQuadPointOrder(o.p[0], o.p[1]) {
+			points = append(points, point(ij[0], ij[1], 0))
+		}
+	case 3:
+		vtkType = vtkBezierHexahedron
+		for _, ijk := range vtkHexPointOrder(o.p[0], o.p[1], o.p[2]) {
+			points = append(points, point(ijk[0], ijk[1], ijk[2]))
+		}
+	default:
+		return nil, nil, 0, degree, false
+	}
+	conn := make([]int, len(points))
+	for i := range conn {
+		conn[i] = i
+	}
+	cells = [][]int{conn}
+	ok = true
+	return
+}
+
+// vtkEdgePointOrder returns, for a degree-p Bezier edge, the local control-point indices
+// (0..p) in VTK's point order: both endpoints first, then the p-1 interior points in
+// increasing parameter order.
+func vtkEdgePointOrder(p int) []int {
+	order := []int{0, p}
+	for i := 1; i < p; i++ {
+		order = append(order, i)
+	}
+	return order
+}
+
+// vtkQuadPointOrder returns, for a degree-(p,q) Bezier quad, the local control-net
+// (i,j) indices in VTK's point order: the 4 corners, then the 4 edges (each traversed
+// so the whole boundary winds consistently), then the face interior in row-major order.
+func vtkQuadPointOrder(p, q int) [][2]int {
+	order := [][2]int{{0, 0}, {p, 0}, {p, q}, {0, q}}
+	for i := 1; i < p; i++ {
+		order = append(order, [2]int{i, 0})
+	}
+	for j := 1; j < q; j++ {
+		order = append(order, [2]int{p, j})
+	}
+	for i := p - 1; i >= 1; i-- {
+		order = append(order, [2]int{i, q})
+	}
+	for j := q - 1; j >= 1; j-- {
+		order = append(order, [2]int{0, j})
+	}
+	for j := 1; j < q; j++ {
+		for i := 1; i < p; i++ {
+			order = append(order, [2]int{i, j})
+		}
+	}
+	return order
+}
+
+// vtkHexPointOrder returns, for a degree-(p,q,r) Bezier hex, the local control-net
+// (i,j,k) indices in VTK's point order: the 8 corners, the 12 edges, the 6 faces (each
+// face's interior in row-major order over its two free directions), then the volume
+// interior.
+func vtkHexPointOrder(p, q, r int) [][3]int {
+	order := [][3]int{
+		{0, 0, 0}, {p, 0, 0}, {p, q, 0}, {0, q, 0},
+		{0, 0, r}, {p, 0, r}, {p, q, r}, {0, q, r},
+	}
+	for i := 1; i < p; i++ {
+		order = append(order, [3]int{i, 0, 0})
+	}
+	for j := 1; j < q; j++ {
+		order = append(order, [3]int{p, j, 0})
+	}
+	for i := p - 1; i >= 1; i-- {
+		order = append(order, [3]int{i, q, 0})
+	}
+	for j := q - 1; j >= 1; j-- {
+		order = append(order, [3]int{0, j, 0})
+	}
+	for i := 1; i < p; i++ {
+		order = append(order, [3]int{i, 0, r})
+	}
+	for j := 1; j < q; j++ {
+		order = append(order, [3]int{p, j, r})
+	}
+	for i := p - 1; i >= 1; i-- {
+		order = append(order, [3]int{i, q, r})
+	}
+	for j := q - 1; j >= 1; j-- {
+		order = append(order, [3]int{0, j, r})
+	}
+	for k := 1; k < r; k++ {
+		order = append(order, [3]int{0, 0, k})
+	}
+	for k := 1; k < r; k++ {
+		order = append(order, [3]int{p, 0, k})
+	}
+	for k := 1; k < r; k++ {
+		order = append(order, [3]int{p, q, k})
+	}
+	for k := 1; k < r; k++ {
+		order = append(order, [3]int{0, q, k})
+	}
+	for k := 1; k < r; k++ {
+		for i := 1; i < p; i++ {
+			order = append(order, [3]int{i, 0, k})
+		}
+	}
+	for k := 1; k < r; k++ {
+		for j := 1; j < q; j++ {
+			order = append(order, [3]int{p, j, k})
+		}
+	}
+	for k := 1; k < r; k++ {
+		for i := 1; i < p; i++ {
+			order = append(order, [3]int{i, q, k})
+		}
+	}
+	for k := 1; k < r; k++ {
+		for j := 1; j < q; j++ {
+			order = append(order, [3]int{0, j, k})
+		}
+	}
+	for j := 1; j < q; j++ {
+		for i := 1; i < p; i++ {
+			order = append(order, [3]int{i, j, 0})
+		}
+	}
+	for j := 1; j < q; j++ {
+		for i := 1; i < p; i++ {
+			order = append(order, [3]int{i, j, r})
+		}
+	}
+	for k := 1; k < r; k++ {
+		for j := 1; j < q; j++ {
+			for i := 1; i < p; i++ {
+				order = append(order, [3]int{i, j, k})
+			}
+		}
+	}
+	return order
+}
+
+// knotMultiplicity counts how many consecutive knots around T[idx] equal T[idx]
+func knotMultiplicity(T []float64, idx int) int {
+	m := 1
+	for i := idx - 1; i >= 0 && T[i] == T[idx]; i-- {
+		m++
+	}
+	for i := idx + 1; i < len(T) && T[i] == T[idx]; i++ {
+		m++
+	}
+	return m
+}
+
+// jacobianOfCell approximates a cell's Jacobian determinant from the edge vectors at
+// its first point; it's a coarse per-element distortion measure, not a value at any
+// particular quadrature point. The cell kind is dispatched on the element's parametric
+// dimension (o.gnd), not on len(conn): a quadratic Bezier curve has 3 points and a
+// quadratic Bezier quad has 9, both of which point-count heuristics misclassify.
+func jacobianOfCell(points [][4]float64, conn []int, gnd int) float64 {
+	if len(conn) < 2 {
+		return 0
+	}
+	p0 := points[conn[0]]
+	e1 := sub3(points[conn[1]], p0)
+	switch gnd {
+	case 1: // line/curve: conn[1] is always the other endpoint (see vtkEdgePointOrder)
+		return vecLen(e1)
+	case 2: // quad: conn[2] is always the corner diagonally across from conn[0] (see vtkQuadPointOrder)
+		e2 := sub3(points[conn[2]], p0)
+		return vecLen(cross3(e1, e2))
+	default: // hexahedron
+		var e2, e3 [3]float64
+		for _, c := range conn {
+			d := sub3(points[c], p0)
+			if d[1] != 0 && e2 == ([3]float64{}) {
+				e2 = d
+			}
+			if d[2] != 0 && e3 == ([3]float64{}) {
+				e3 = d
+			}
+		}
+		return det3(e1, e2, e3)
+	}
+}
+
+func sub3(a, b [4]float64) [3]float64 {
+	return [3]float64{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func vecLen(a [3]float64) float64 {
+	return math.Sqrt(a[0]*a[0] + a[1]*a[1] + a[2]*a[2])
+}
+
+func cross3(a, b [3]float64) [3]float64 {
+	return [3]float64{
+		a[1]*b[2] - a[2]*b[1],
+		a[2]*b[0] - a[0]*b[2],
+		a[0]*b[1] - a[1]*b[0],
+	}
+}
+
+func det3(a, b, c [3]float64) float64 {
+	return a[0]*(b[1]*c[2]-b[2]*c[1]) - a[1]*(b[0]*c[2]-b[2]*c[0]) + a[2]*(b[0]*c[1]-b[1]*c[0])
+}
+
+// vtuAppended accumulates the raw bytes of every "appended" DataArray so they can be
+// base64-encoded as a single block at the end of the file
+type vtuAppended struct {
+	buf bytes.Buffer
+}
+
+func (a *vtuAppended) addFloat64(vals []float64) (offset int) {
+	offset = a.buf.Len()
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(vals)*8))
+	a.buf.Write(hdr[:])
+	binary.Write(&a.buf, binary.LittleEndian, vals)
+	return
+}
+
+func (a *vtuAppended) addInt32(vals []int32) (offset int) {
+	offset = a.buf.Len()
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(vals)*4))
+	a.buf.Write(hdr[:])
+	binary.Write(&a.buf, binary.LittleEndian, vals)
+	return
+}
+
+// writeVTUFile assembles and writes the .vtu XML document
+func writeVTUFile(dirout, fnk string, points [][4]float64, cells [][]int, cellTypes []int, cellDegrees [][3]int, cellPatch, cellElem []int, cellJac []float64, opts *TessOpts) (err error) {
+	nPoints := len(points)
+	nCells := len(cells)
+
+	offsets := make([]int32, nCells)
+	var running int32
+	var conn []int32
+	for i, c := range cells {
+		for _, idx := range c {
+			conn = append(conn, int32(idx))
+		}
+		running += int32(len(c))
+		offsets[i] = running
+	}
+	types := make([]int32, nCells)
+	for i, t := range cellTypes {
+		types[i] = int32(t)
+	}
+
+	var coords, ws []float64
+	for _, p := range points {
+		coords = append(coords, p[0], p[1], p[2])
+		ws = append(ws, p[3])
+	}
+
+	var app vtuAppended
+	var buf bytes.Buffer
+	utl.Ff(&buf, "<?xml version=\"1.0\"?>\n")
+	byteOrder := "LittleEndian"
+	if opts.Binary {
+		utl.Ff(&buf, "<VTKFile type=\"UnstructuredGrid\" version=\"0.1\" byte_order=\"%s\">\n", byteOrder)
+	} else {
+		utl.Ff(&buf, "<VTKFile type=\"UnstructuredGrid\" version=\"0.1\">\n")
+	}
+	utl.Ff(&buf, "  <UnstructuredGrid>\n")
+	utl.Ff(&buf, "    <Piece NumberOfPoints=\"%d\" NumberOfCells=\"%d\">\n", nPoints, nCells)
+
+	utl.Ff(&buf, "      <Points>\n")
+	writeFloatArray(&buf, &app, "Points", 3, coords, opts.Binary)
+	utl.Ff(&buf, "      </Points>\n")
+
+	utl.Ff(&buf, "      <Cells>\n")
+	writeInt32Array(&buf, &app, "connectivity", conn, opts.Binary)
+	writeInt32Array(&buf, &app, "offsets", offsets, opts.Binary)
+	writeInt32Array(&buf, &app, "types", types, opts.Binary)
+	utl.Ff(&buf, "      </Cells>\n")
+
+	utl.Ff(&buf, "      <PointData>\n")
+	if opts.WithPointIds {
+		ids := make([]int32, nPoints)
+		for i := range ids {
+			ids[i] = -1
+		}
+		for i, c := range cells {
+			if cellDegrees[i][0] < 0 {
+				continue
+			}
+			for _, idx := range c {
+				p := points[idx]
+				ids[idx] = int32(HashPoint(p[0], p[1], p[2]))
+			}
+		}
+		writeInt32Array(&buf, &app, "ControlPointId", ids, opts.Binary)
+	}
+	writeFloatArray(&buf, &app, "RationalWeights", 1, ws, opts.Binary)
+	utl.Ff(&buf, "      </PointData>\n")
+
+	utl.Ff(&buf, "      <CellData>\n")
+	if opts.WithTags {
+		p32 := make([]int32, nCells)
+		e32 := make([]int32, nCells)
+		for i := range cellPatch {
+			p32[i], e32[i] = int32(cellPatch[i]), int32(cellElem[i])
+		}
+		writeInt32Array(&buf, &app, "PatchId", p32, opts.Binary)
+		writeInt32Array(&buf, &app, "ElemId", e32, opts.Binary)
+	}
+	if opts.WithJacobian {
+		writeFloatArray(&buf, &app, "Jacobian", 1, cellJac, opts.Binary)
+	}
+	hasBezier := false
+	degs := make([]int32, 3*nCells)
+	for i, d := range cellDegrees {
+		if d[0] >= 0 {
+			hasBezier = true
+		}
+		for k := 0; k < 3; k++ {
+			degs[3*i+k] = int32(d[k])
+		}
+	}
+	if hasBezier {
+		writeInt32ArrayN(&buf, &app, "HigherOrderDegrees", degs, 3, opts.Binary)
+	}
+	utl.Ff(&buf, "      </CellData>\n")
+
+	utl.Ff(&buf, "    </Piece>\n")
+	utl.Ff(&buf, "  </UnstructuredGrid>\n")
+	if opts.Binary {
+		utl.Ff(&buf, "  <AppendedData encoding=\"base64\">\n_%s\n  </AppendedData>\n", base64.StdEncoding.EncodeToString(app.buf.Bytes()))
+	}
+	utl.Ff(&buf, "</VTKFile>\n")
+
+	utl.WriteFileVD(dirout, fnk+".vtu", &buf)
+	return nil
+}
+
+// writeFloatArray emits one Float64 DataArray, inline as ASCII or as an offset into the
+// appended-data block, depending on binary
+func writeFloatArray(buf *bytes.Buffer, app *vtuAppended, name string, nc int, vals []float64, binaryMode bool) {
+	if binaryMode {
+		off := app.addFloat64(vals)
+		utl.Ff(buf, "        <DataArray type=\"Float64\" Name=\"%s\" NumberOfComponents=\"%d\" format=\"appended\" offset=\"%d\"/>\n", name, nc, off)
+		return
+	}
+	utl.Ff(buf, "        <DataArray type=\"Float64\" Name=\"%s\" NumberOfComponents=\"%d\" format=\"ascii\">\n          ", name, nc)
+	for i, v := range vals {
+		if i > 0 {
+			utl.Ff(buf, " ")
+		}
+		utl.Ff(buf, "%.17e", v)
+	}
+	utl.Ff(buf, "\n        </DataArray>\n")
+}
+
+// writeInt32Array emits one single-component Int32 DataArray
+func writeInt32Array(buf *bytes.Buffer, app *vtuAppended, name string, vals []int32, binaryMode bool) {
+	writeInt32ArrayN(buf, app, name, vals, 1, binaryMode)
+}
+
+// writeInt32ArrayN emits one nc-component Int32 DataArray, inline as ASCII or as an
+// offset into the appended-data block, depending on binary
+func writeInt32ArrayN(buf *bytes.Buffer, app *vtuAppended, name string, vals []int32, nc int, binaryMode bool) {
+	if binaryMode {
+		off := app.addInt32(vals)
+		utl.Ff(buf, "        <DataArray type=\"Int32\" Name=\"%s\" NumberOfComponents=\"%d\" format=\"appended\" offset=\"%d\"/>\n", name, nc, off)
+		return
+	}
+	utl.Ff(buf, "        <DataArray type=\"Int32\" Name=\"%s\" NumberOfComponents=\"%d\" format=\"ascii\">\n          ", name, nc)
+	for i, v := range vals {
+		if i > 0 {
+			utl.Ff(buf, " ")
+		}
+		utl.Ff(buf, "%d", v)
+	}
+	utl.Ff(buf, "\n        </DataArray>\n")
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import "testing"
+
+// assertPermutation checks that indices cover every value in [0,n) exactly once.
+func assertPermutation(t *testing.T, n int, indices func(i int) int) {
+	t.Helper()
+	seen := make([]bool, n)
+	for i := 0; i < n; i++ {
+		k := indices(i)
+		if k < 0 || k >= n {
+			t.Fatalf("index %d out of range [0,%d)", k, n)
+		}
+		if seen[k] {
+			t.Fatalf("index %d produced twice", k)
+		}
+		seen[k] = true
+	}
+}
+
+func TestVtkEdgePointOrder(t *testing.T) {
+	for _, p := range []int{1, 2, 3, 4} {
+		order := vtkEdgePointOrder(p)
+		if len(order) != p+1 {
+			t.Fatalf("degree %d: got %d points, want %d", p, len(order), p+1)
+		}
+		assertPermutation(t, p+1, func(i int) int { return order[i] })
+		if order[0] != 0 || order[1] != p {
+			t.Fatalf("degree %d: endpoints not first, got %v", p, order)
+		}
+	}
+}
+
+func TestVtkQuadPointOrder(t *testing.T) {
+	for _, pq := range [][2]int{{1, 1}, {2, 2}, {2, 3}, {3, 1}} {
+		p, q := pq[0], pq[1]
+		order := vtkQuadPointOrder(p, q)
+		n := (p + 1) * (q + 1)
+		if len(order) != n {
+			t.Fatalf("degree (%d,%d): got %d points, want %d", p, q, len(order), n)
+		}
+		toFlat := func(ij [2]int) int { return ij[0] + ij[1]*(p+1) }
+		assertPermutation(t, n, func(i int) int { return toFlat(order[i]) })
+		corners := [][2]int{{0, 0}, {p, 0}, {p, q}, {0, q}}
+		for i, c := range corners {
+			if order[i] != c {
+				t.Fatalf("degree (%d,%d): corner %d = %v, want %v", p, q, i, order[i], c)
+			}
+		}
+	}
+}
+
+func TestVtkHexPointOrder(t *testing.T) {
+	for _, pqr := range [][3]int{{1, 1, 1}, {2, 2, 2}, {2, 1, 3}} {
+		p, q, r := pqr[0], pqr[1], pqr[2]
+		order := vtkHexPointOrder(p, q, r)
+		n := (p + 1) * (q + 1) * (r + 1)
+		if len(order) != n {
+			t.Fatalf("degree (%d,%d,%d): got %d points, want %d", p, q, r, len(order), n)
+		}
+		toFlat := func(ijk [3]int) int { return ijk[0] + ijk[1]*(p+1) + ijk[2]*(p+1)*(q+1) }
+		assertPermutation(t, n, func(i int) int { return toFlat(order[i]) })
+		corners := [][3]int{
+			{0, 0, 0}, {p, 0, 0}, {p, q, 0}, {0, q, 0},
+			{0, 0, r}, {p, 0, r}, {p, q, r}, {0, q, r},
+		}
+		for i, c := range corners {
+			if order[i] != c {
+				t.Fatalf("degree (%d,%d,%d): corner %d = %v, want %v", p, q, r, i, order[i], c)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import "math"
+
+// PointIndex is a collision-safe replacement for keying control points by HashPoint: it
+// quantizes (x,y,z) to Tol and, on a quantization-bucket hit, verifies the candidate
+// against the stored float coordinates (including the weight w) with an L-infinity
+// tolerance before treating it as the same point. This avoids two failure modes of
+// HashPoint(x,y,z)=int(x*10001+y*1000001+z*100000001): it ignores w entirely, so two
+// control points at the same position but different weights get silently merged; and
+// its fixed integer scaling folds distinct vertices onto the same key once coordinates
+// are around 1e6 or 1e-6.
+type PointIndex struct {
+	Tol    float64
+	ids    map[[3]int64][]int
+	coords [][4]float64
+}
+
+// NewPointIndex creates a PointIndex that treats two points as equal when every
+// coordinate (including w) differs by no more than tol. If tol<=0, 1e-12 is used.
+func NewPointIndex(tol float64) *PointIndex {
+	if tol <= 0 {
+		tol = 1e-12
+	}
+	return &PointIndex{Tol: tol, ids: make(map[[3]int64][]int)}
+}
+
+// DefaultPointTol returns 1e-12 times the bounding-box diagonal of pts (each at least a
+// 3-vector), the tolerance WriteMshD uses unless told otherwise. It falls back to 1e-12
+// outright for an empty or degenerate (zero-diagonal) point set.
+func DefaultPointTol(pts [][]float64) float64 {
+	if len(pts) == 0 {
+		return 1e-12
+	}
+	var lo, hi [3]float64
+	lo[0], lo[1], lo[2] = pts[0][0], pts[0][1], pts[0][2]
+	hi = lo
+	for _, p := range pts {
+		for d := 0; d < 3; d++ {
+			if p[d] < lo[d] {
+				lo[d] = p[d]
+			}
+			if p[d] > hi[d] {
+				hi[d] = p[d]
+			}
+		}
+	}
+	dx, dy, dz := hi[0]-lo[0], hi[1]-lo[1], hi[2]-lo[2]
+	diag := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if diag == 0 {
+		return 1e-12
+	}
+	return diag * 1e-12
+}
+
+// quantize maps (x,y,z) onto the integer lattice cell it falls in at the index's
+// tolerance, used as the map key
+func (pi *PointIndex) quantize(x, y, z float64) [3]int64 {
+	return [3]int64{
+		int64(math.Floor(x / pi.Tol)),
+		int64(math.Floor(y / pi.Tol)),
+		int64(math.Floor(z / pi.Tol)),
+	}
+}
+
+// Add looks up (x,y,z,w). If a previously added point matches within Tol, its id is
+// returned with isNew=false; otherwise (x,y,z,w) is stored under a new id and isNew is
+// true. The 26 quantization cells around (x,y,z)'s own cell are also checked, so a point
+// that falls just across a cell boundary from an equal point still matches it. A
+// quantization cell may hold several distinct points (e.g. coincident positions with
+// different weights), so every candidate id chained under a bucket is checked, not just
+// the most recently added one.
+func (pi *PointIndex) Add(x, y, z, w float64) (id int, isNew bool) {
+	key := pi.quantize(x, y, z)
+	for di := int64(-1); di <= 1; di++ {
+		for dj := int64(-1); dj <= 1; dj++ {
+			for dk := int64(-1); dk <= 1; dk++ {
+				k := [3]int64{key[0] + di, key[1] + dj, key[2] + dk}
+				for _, cid := range pi.ids[k] {
+					c := pi.coords[cid]
+					if math.Abs(c[0]-x) <= pi.Tol && math.Abs(c[1]-y) <= pi.Tol &&
+						math.Abs(c[2]-z) <= pi.Tol && math.Abs(c[3]-w) <= pi.Tol {
+						return cid, false
+					}
+				}
+			}
+		}
+	}
+	id = len(pi.coords)
+	pi.coords = append(pi.coords, [4]float64{x, y, z, w})
+	pi.ids[key] = append(pi.ids[key], id)
+	return id, true
+}
+
+// Coord returns the (x,y,z,w) stored under id, as returned by Add
+func (pi *PointIndex) Coord(id int) [4]float64 {
+	return pi.coords[id]
+}
+
+// Len returns the number of distinct points currently stored
+func (pi *PointIndex) Len() int {
+	return len(pi.coords)
+}
@@ -0,0 +1,55 @@
+// Copyright 2012 Dorival de Moraes Pedroso. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gm
+
+import "testing"
+
+// TestPointIndexCoincidentWeightsThenRepeat exercises the exact scenario PointIndex
+// exists for: two control points at the same position but different weights must get
+// distinct ids, and re-adding the first of those two afterwards must still return its
+// original id rather than a fresh one (a bucket may hold more than one point).
+func TestPointIndexCoincidentWeightsThenRepeat(t *testing.T) {
+	pi := NewPointIndex(1e-9)
+
+	id0, isNew0 := pi.Add(1, 1, 1, 1)
+	if !isNew0 || id0 != 0 {
+		t.Fatalf("first Add: got id=%d isNew=%v, want id=0 isNew=true", id0, isNew0)
+	}
+
+	id1, isNew1 := pi.Add(1, 1, 1, 2)
+	if !isNew1 || id1 != 1 {
+		t.Fatalf("coincident point with different weight: got id=%d isNew=%v, want id=1 isNew=true", id1, isNew1)
+	}
+
+	id2, isNew2 := pi.Add(1, 1, 1, 1)
+	if isNew2 || id2 != id0 {
+		t.Fatalf("re-adding the first point: got id=%d isNew=%v, want id=%d isNew=false", id2, isNew2, id0)
+	}
+
+	if pi.Len() != 2 {
+		t.Fatalf("expected 2 distinct points stored, got %d", pi.Len())
+	}
+}
+
+// TestPointIndexManyCoincidentPoints checks that a bucket chains an arbitrary number of
+// distinct points, not just two.
+func TestPointIndexManyCoincidentPoints(t *testing.T) {
+	pi := NewPointIndex(1e-9)
+	const n = 10
+	ids := make([]int, n)
+	for i := 0; i < n; i++ {
+		id, isNew := pi.Add(0, 0, 0, float64(i))
+		if !isNew {
+			t.Fatalf("Add #%d: expected a new id, got isNew=false", i)
+		}
+		ids[i] = id
+	}
+	for i := 0; i < n; i++ {
+		id, isNew := pi.Add(0, 0, 0, float64(i))
+		if isNew || id != ids[i] {
+			t.Fatalf("re-adding point #%d: got id=%d isNew=%v, want id=%d isNew=false", i, id, isNew, ids[i])
+		}
+	}
+}